@@ -0,0 +1,250 @@
+package llama
+
+/*
+#include <stdlib.h>
+#include "llama.h"
+*/
+import "C"
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"sync"
+	"unsafe"
+)
+
+// WithCache attaches a Cache that Predict consults for the longest matching token prefix before falling back to
+// the existing history-overlap reset. This lets prompt evaluation (a system prompt, a RAG context) be amortized
+// across Predict calls that do not otherwise share a single stream.
+func WithCache(c Cache) Option {
+	return func(m *model) { m.cache = c }
+}
+
+// Cache stores State snapshots keyed by the token prefix that produced them. Implementations need only find the
+// longest stored prefix of the tokens passed to Get; NewRAMCache and NewDiskCache caches both do this with a linear scan over
+// their entries, which is fine since entries are bounded by capacity in bytes rather than by count.
+type Cache interface {
+	// Get returns the State for the longest stored prefix of tokens, and how many leading tokens it covers.
+	Get(tokens []Token) (s *State, n int, ok bool)
+
+	// Put stores a State under prefix, evicting the least-recently-used entries until within capacity.
+	Put(prefix []Token, s *State)
+
+	// Size returns the total size in bytes of the State snapshots currently held.
+	Size() int64
+}
+
+// State is an opaque snapshot of a llama_context's KV state and rng, captured with llama_copy_state_data and
+// restored with llama_set_state_data.
+type State struct {
+	buf []byte
+}
+
+// captureState snapshots the current KV state of ctx.
+func captureState(ctx *C.struct_llama_context) *State {
+	sz := C.llama_get_state_size(ctx)
+	if sz == 0 {
+		return &State{}
+	}
+	buf := make([]byte, int(sz))
+	n := C.llama_copy_state_data(ctx, (*C.uint8_t)(unsafe.Pointer(&buf[0])))
+	return &State{buf: buf[:int(n)]}
+}
+
+// restore replaces the KV state of ctx with the snapshot held by s.
+func (s *State) restore(ctx *C.struct_llama_context) {
+	if len(s.buf) == 0 {
+		return
+	}
+	C.llama_set_state_data(ctx, (*C.uint8_t)(unsafe.Pointer(&s.buf[0])))
+}
+
+// Size returns the size of the snapshot in bytes.
+func (s *State) Size() int64 { return int64(len(s.buf)) }
+
+// commonPrefixLen returns how many leading tokens a and b have in common.
+func commonPrefixLen(a, b []Token) int {
+	n := len(a)
+	if len(b) < n {
+		n = len(b)
+	}
+	for i := 0; i < n; i++ {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	return n
+}
+
+// tokenKey renders tokens into a comparable map key.
+func tokenKey(tokens []Token) string {
+	var buf bytes.Buffer
+	buf.Grow(len(tokens) * 4)
+	for _, t := range tokens {
+		binary.Write(&buf, binary.LittleEndian, int32(t))
+	}
+	return buf.String()
+}
+
+// ramCache is an in-RAM, least-recently-used Cache, analogous to llama-cpp-python's LlamaRAMCache.
+type ramCache struct {
+	mu       sync.Mutex
+	capacity int64
+	size     int64
+	order    *list.List // front = most recently used
+	index    map[string]*list.Element
+}
+
+type ramCacheEntry struct {
+	prefix []Token
+	state  *State
+}
+
+// NewRAMCache returns a Cache that holds State snapshots in memory, evicting the least-recently-used entry once
+// Size would exceed capacityBytes.
+func NewRAMCache(capacityBytes int64) Cache {
+	return &ramCache{
+		capacity: capacityBytes,
+		order:    list.New(),
+		index:    make(map[string]*list.Element),
+	}
+}
+
+func (c *ramCache) Get(tokens []Token) (*State, int, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var best *list.Element
+	bestN := 0
+	for e := c.order.Front(); e != nil; e = e.Next() {
+		n := commonPrefixLen(tokens, e.Value.(*ramCacheEntry).prefix)
+		if n > bestN {
+			bestN, best = n, e
+		}
+	}
+	if best == nil {
+		return nil, 0, false
+	}
+	c.order.MoveToFront(best)
+	return best.Value.(*ramCacheEntry).state, bestN, true
+}
+
+func (c *ramCache) Put(prefix []Token, s *State) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := tokenKey(prefix)
+	if e, ok := c.index[key]; ok {
+		c.size -= e.Value.(*ramCacheEntry).state.Size()
+		c.order.Remove(e)
+		delete(c.index, key)
+	}
+	c.size += s.Size()
+	c.index[key] = c.order.PushFront(&ramCacheEntry{prefix: prefix, state: s})
+	for c.size > c.capacity && c.order.Len() > 0 {
+		back := c.order.Back()
+		entry := back.Value.(*ramCacheEntry)
+		c.size -= entry.state.Size()
+		c.order.Remove(back)
+		delete(c.index, tokenKey(entry.prefix))
+	}
+}
+
+func (c *ramCache) Size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size
+}
+
+// diskCache is an on-disk, least-recently-used Cache, analogous to llama-cpp-python's LlamaDiskCache. State
+// snapshots are written as individual files under dir and read back lazily on Get.
+type diskCache struct {
+	mu       sync.Mutex
+	dir      string
+	capacity int64
+	size     int64
+	order    *list.List
+	index    map[string]*list.Element
+}
+
+type diskCacheEntry struct {
+	prefix []Token
+	path   string
+	size   int64
+}
+
+// NewDiskCache returns a Cache that holds State snapshots as files under dir, evicting the least-recently-used
+// entry once Size would exceed capacityBytes.
+func NewDiskCache(dir string, capacityBytes int64) (Cache, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+	return &diskCache{
+		dir:      dir,
+		capacity: capacityBytes,
+		order:    list.New(),
+		index:    make(map[string]*list.Element),
+	}, nil
+}
+
+func (c *diskCache) Get(tokens []Token) (*State, int, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var best *list.Element
+	bestN := 0
+	for e := c.order.Front(); e != nil; e = e.Next() {
+		n := commonPrefixLen(tokens, e.Value.(*diskCacheEntry).prefix)
+		if n > bestN {
+			bestN, best = n, e
+		}
+	}
+	if best == nil {
+		return nil, 0, false
+	}
+	entry := best.Value.(*diskCacheEntry)
+	buf, err := os.ReadFile(entry.path)
+	if err != nil {
+		return nil, 0, false
+	}
+	c.order.MoveToFront(best)
+	return &State{buf: buf}, bestN, true
+}
+
+func (c *diskCache) Put(prefix []Token, s *State) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := tokenKey(prefix)
+	if e, ok := c.index[key]; ok {
+		entry := e.Value.(*diskCacheEntry)
+		c.size -= entry.size
+		c.order.Remove(e)
+		delete(c.index, key)
+		os.Remove(entry.path)
+	}
+	sum := sha1.Sum([]byte(key))
+	path := filepath.Join(c.dir, hex.EncodeToString(sum[:])+`.ggst`)
+	err := os.WriteFile(path, s.buf, 0o644)
+	if err != nil {
+		return
+	}
+	c.size += s.Size()
+	c.index[key] = c.order.PushFront(&diskCacheEntry{prefix: prefix, path: path, size: s.Size()})
+	for c.size > c.capacity && c.order.Len() > 0 {
+		back := c.order.Back()
+		entry := back.Value.(*diskCacheEntry)
+		c.size -= entry.size
+		c.order.Remove(back)
+		delete(c.index, tokenKey(entry.prefix))
+		os.Remove(entry.path)
+	}
+}
+
+func (c *diskCache) Size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size
+}
@@ -0,0 +1,421 @@
+package llama
+
+/*
+#include <stdlib.h>
+#include "llama.h"
+*/
+import "C"
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+	"unsafe"
+)
+
+// Grammar is a GBNF (GGML BNF) grammar, as documented at
+// https://github.com/ggerganov/llama.cpp/blob/master/grammars/README.md, compiled into the rule arrays that
+// llama_grammar_init expects. Passing Parameters.Grammar compiles one of these for the lifetime of a Stream, and
+// constrains every token sampled by that stream to one the grammar accepts.
+type Grammar struct {
+	rules []string       // rule name by index; synthetic rules (from ?, *, +) have generated names
+	elems [][]element    // rule bodies, parallel to rules
+	index map[string]int // rule name -> index into rules/elems
+	root  int
+}
+
+type element struct {
+	typ   C.enum_llama_gretype
+	value uint32
+}
+
+// ParseGrammar compiles GBNF grammar text into a Grammar that can be used as Parameters.Grammar.
+func ParseGrammar(text string) (*Grammar, error) {
+	p := &gbnfParser{text: text, g: &Grammar{index: make(map[string]int)}}
+	err := p.parse()
+	if err != nil {
+		return nil, err
+	}
+	root, ok := p.g.index[`root`]
+	if !ok {
+		return nil, fmt.Errorf(`grammar has no "root" rule`)
+	}
+	p.g.root = root
+	return p.g, nil
+}
+
+type gbnfParser struct {
+	text string
+	pos  int
+	g    *Grammar
+}
+
+func (p *gbnfParser) parse() error {
+	p.skipWS()
+	for p.pos < len(p.text) {
+		err := p.parseRule()
+		if err != nil {
+			return err
+		}
+		p.skipWS()
+	}
+	if len(p.g.rules) == 0 {
+		return fmt.Errorf(`grammar is empty`)
+	}
+	return nil
+}
+
+func (p *gbnfParser) parseRule() error {
+	name, err := p.parseIdentifier()
+	if err != nil {
+		return err
+	}
+	p.skipWS()
+	if !p.consume(`::=`) {
+		return fmt.Errorf(`expected "::=" after rule %q at offset %v`, name, p.pos)
+	}
+	p.skipWS()
+	body, err := p.parseAlternates()
+	if err != nil {
+		return err
+	}
+	p.defineRule(name, body)
+	return nil
+}
+
+// defineRule stores body under name, allocating a new index the first time name is seen so forward references
+// (a rule referring to a rule defined later in the file) resolve correctly.
+func (p *gbnfParser) defineRule(name string, body []element) int {
+	i, ok := p.g.index[name]
+	if !ok {
+		i = len(p.g.rules)
+		p.g.rules = append(p.g.rules, name)
+		p.g.elems = append(p.g.elems, nil)
+		p.g.index[name] = i
+	}
+	p.g.elems[i] = body
+	return i
+}
+
+// ruleRef returns the index for name, reserving one if this is a forward reference to a rule not yet defined.
+func (p *gbnfParser) ruleRef(name string) int {
+	i, ok := p.g.index[name]
+	if !ok {
+		i = len(p.g.rules)
+		p.g.rules = append(p.g.rules, name)
+		p.g.elems = append(p.g.elems, nil)
+		p.g.index[name] = i
+	}
+	return i
+}
+
+// parseAlternates parses "seq1 | seq2 | ..." and returns the flattened rule body: each sequence, with
+// LLAMA_GRETYPE_ALT markers between them, terminated by LLAMA_GRETYPE_END.
+func (p *gbnfParser) parseAlternates() ([]element, error) {
+	var out []element
+	seq, err := p.parseSequence()
+	if err != nil {
+		return nil, err
+	}
+	out = append(out, seq...)
+	for {
+		p.skipWS()
+		if !p.consume(`|`) {
+			break
+		}
+		p.skipWS()
+		out = append(out, element{typ: C.LLAMA_GRETYPE_ALT})
+		seq, err = p.parseSequence()
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, seq...)
+	}
+	out = append(out, element{typ: C.LLAMA_GRETYPE_END})
+	return out, nil
+}
+
+func (p *gbnfParser) parseSequence() ([]element, error) {
+	var out []element
+	for {
+		p.skipWS()
+		if p.pos >= len(p.text) {
+			break
+		}
+		c := p.text[p.pos]
+		if c == '|' || c == ')' || c == '\n' || c == 0 {
+			break
+		}
+		// skipWS crosses newlines, so the sequence ends where the next rule's "name ::=" begins.
+		start := p.pos
+		if _, err := p.parseIdentifier(); err == nil {
+			p.skipWS()
+			next := strings.HasPrefix(p.text[p.pos:], `::=`)
+			p.pos = start
+			if next {
+				break
+			}
+		}
+		item, err := p.parseItem()
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, item...)
+	}
+	return out, nil
+}
+
+// parseItem parses a single atom (rule reference, literal, char class, or parenthesized group) and applies a
+// trailing ?, * or + by synthesizing an anonymous helper rule, the same strategy llama.cpp's own grammar parser
+// uses to keep the element encoding flat.
+func (p *gbnfParser) parseItem() ([]element, error) {
+	var atom []element
+	var err error
+	switch {
+	case p.text[p.pos] == '(':
+		p.pos++
+		p.skipWS()
+		body, err := p.parseAlternates()
+		if err != nil {
+			return nil, err
+		}
+		p.skipWS()
+		if !p.consume(`)`) {
+			return nil, fmt.Errorf(`expected ")" at offset %v`, p.pos)
+		}
+		// A parenthesized group can itself be an alternation, and alternation markers are only meaningful as the
+		// entire body of a rule, so it is hoisted into its own anonymous rule and referenced by index rather than
+		// inlined into the enclosing sequence.
+		i := p.defineRule(fmt.Sprintf(`anon$%d`, len(p.g.rules)), body)
+		atom = []element{{typ: C.LLAMA_GRETYPE_RULE_REF, value: uint32(i)}}
+	case p.text[p.pos] == '"' || p.text[p.pos] == '\'':
+		atom, err = p.parseLiteral()
+	case p.text[p.pos] == '[':
+		atom, err = p.parseCharClass()
+	case p.text[p.pos] == '.':
+		p.pos++
+		atom = []element{{typ: C.LLAMA_GRETYPE_CHAR_ANY}}
+	default:
+		var name string
+		name, err = p.parseIdentifier()
+		if err == nil {
+			atom = []element{{typ: C.LLAMA_GRETYPE_RULE_REF, value: uint32(p.ruleRef(name))}}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.text) {
+		switch p.text[p.pos] {
+		case '?', '*', '+':
+			return p.wrapRepetition(atom, p.text[p.pos]), nil
+		}
+	}
+	return atom, nil
+}
+
+// wrapRepetition synthesizes an anonymous rule implementing op (?, * or +) over atom, and returns a single
+// RULE_REF element pointing at it, so callers can treat the result as an ordinary atom. atom is a bare element
+// run with no trailing END -- only a complete rule body (built here with defineRule) ever carries one, since
+// LLAMA_GRETYPE_END marks the end of an entire rule's alternates, not of an individual atom.
+func (p *gbnfParser) wrapRepetition(atom []element, op byte) []element {
+	p.pos++ // consume ?, * or +
+	name := fmt.Sprintf(`anon$%d`, len(p.g.rules))
+	switch op {
+	case '?':
+		// anon ::= atom |
+		body := append(append([]element{}, atom...), element{typ: C.LLAMA_GRETYPE_ALT}, element{typ: C.LLAMA_GRETYPE_END})
+		i := p.defineRule(name, body)
+		return []element{{typ: C.LLAMA_GRETYPE_RULE_REF, value: uint32(i)}}
+	case '*':
+		// anon ::= atom anon |
+		i := p.defineRule(name, nil)
+		body := append(append([]element{}, atom...), element{typ: C.LLAMA_GRETYPE_RULE_REF, value: uint32(i)})
+		body = append(body, element{typ: C.LLAMA_GRETYPE_ALT}, element{typ: C.LLAMA_GRETYPE_END})
+		p.defineRule(name, body)
+		return []element{{typ: C.LLAMA_GRETYPE_RULE_REF, value: uint32(i)}}
+	default: // '+'
+		// anon ::= atom anon | atom
+		i := p.defineRule(name, nil)
+		body := append(append([]element{}, atom...), element{typ: C.LLAMA_GRETYPE_RULE_REF, value: uint32(i)})
+		body = append(body, element{typ: C.LLAMA_GRETYPE_ALT})
+		body = append(body, atom...)
+		body = append(body, element{typ: C.LLAMA_GRETYPE_END})
+		p.defineRule(name, body)
+		return []element{{typ: C.LLAMA_GRETYPE_RULE_REF, value: uint32(i)}}
+	}
+}
+
+func (p *gbnfParser) parseLiteral() ([]element, error) {
+	quote := p.text[p.pos]
+	p.pos++
+	var out []element
+	for p.pos < len(p.text) && p.text[p.pos] != quote {
+		r, err := p.nextRune()
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, element{typ: C.LLAMA_GRETYPE_CHAR, value: uint32(r)})
+	}
+	if p.pos >= len(p.text) {
+		return nil, fmt.Errorf(`unterminated literal at offset %v`, p.pos)
+	}
+	p.pos++ // closing quote
+	return out, nil
+}
+
+func (p *gbnfParser) parseCharClass() ([]element, error) {
+	p.pos++ // '['
+	var out []element
+	negate := false
+	if p.pos < len(p.text) && p.text[p.pos] == '^' {
+		negate = true
+		p.pos++
+	}
+	for p.pos < len(p.text) && p.text[p.pos] != ']' {
+		lo, err := p.nextRune()
+		if err != nil {
+			return nil, err
+		}
+		typ := C.enum_llama_gretype(C.LLAMA_GRETYPE_CHAR)
+		if len(out) > 0 {
+			typ = C.LLAMA_GRETYPE_CHAR_ALT
+		} else if negate {
+			typ = C.LLAMA_GRETYPE_CHAR_NOT
+		}
+		out = append(out, element{typ: typ, value: uint32(lo)})
+		if p.pos+1 < len(p.text) && p.text[p.pos] == '-' && p.text[p.pos+1] != ']' {
+			p.pos++
+			hi, err := p.nextRune()
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, element{typ: C.LLAMA_GRETYPE_CHAR_RNG_UPPER, value: uint32(hi)})
+		}
+	}
+	if p.pos >= len(p.text) {
+		return nil, fmt.Errorf(`unterminated character class at offset %v`, p.pos)
+	}
+	p.pos++ // ']'
+	return out, nil
+}
+
+// nextRune reads one (possibly backslash-escaped) rune from a literal or character class.
+func (p *gbnfParser) nextRune() (rune, error) {
+	if p.text[p.pos] == '\\' && p.pos+1 < len(p.text) {
+		p.pos++
+		c := p.text[p.pos]
+		p.pos++
+		switch c {
+		case 'n':
+			return '\n', nil
+		case 'r':
+			return '\r', nil
+		case 't':
+			return '\t', nil
+		default:
+			return rune(c), nil
+		}
+	}
+	r, sz := utf8.DecodeRuneInString(p.text[p.pos:])
+	p.pos += sz
+	return r, nil
+}
+
+func (p *gbnfParser) parseIdentifier() (string, error) {
+	start := p.pos
+	for p.pos < len(p.text) {
+		c := p.text[p.pos]
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' {
+			p.pos++
+			continue
+		}
+		break
+	}
+	if p.pos == start {
+		return ``, fmt.Errorf(`expected identifier at offset %v`, p.pos)
+	}
+	return p.text[start:p.pos], nil
+}
+
+func (p *gbnfParser) consume(tok string) bool {
+	if strings.HasPrefix(p.text[p.pos:], tok) {
+		p.pos += len(tok)
+		return true
+	}
+	return false
+}
+
+func (p *gbnfParser) skipWS() {
+	for p.pos < len(p.text) {
+		switch p.text[p.pos] {
+		case ' ', '\t', '\r', '\n':
+			p.pos++
+		case '#':
+			for p.pos < len(p.text) && p.text[p.pos] != '\n' {
+				p.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+// compiledGrammar holds the llama_grammar handle compiled from a Grammar, live for the lifetime of a stream.
+type compiledGrammar struct {
+	handle *C.struct_llama_grammar
+}
+
+// compile builds the llama_grammar_element rule arrays for g and calls llama_grammar_init. The rule arrays are
+// only read for the duration of the call -- llama_grammar_init copies them into its own storage -- so the backing
+// memory does not need to outlive this function.
+func (g *Grammar) compile() (*compiledGrammar, error) {
+	n := len(g.elems)
+	if n == 0 {
+		return nil, fmt.Errorf(`grammar has no rules`)
+	}
+	cRules := make([][]C.struct_llama_grammar_element, n)
+	for i, body := range g.elems {
+		if len(body) == 0 {
+			return nil, fmt.Errorf(`rule %q is referenced but never defined`, g.rules[i])
+		}
+		row := make([]C.struct_llama_grammar_element, len(body))
+		for j, e := range body {
+			row[j] = C.struct_llama_grammar_element{_type: e.typ, value: C.uint32_t(e.value)}
+		}
+		cRules[i] = row
+	}
+	ptrSize := unsafe.Sizeof((*C.struct_llama_grammar_element)(nil))
+	rows := C.malloc(C.size_t(n) * C.size_t(ptrSize))
+	defer C.free(rows)
+	rowPtrs := unsafe.Slice((**C.struct_llama_grammar_element)(rows), n)
+	for i, row := range cRules {
+		rowPtrs[i] = (*C.struct_llama_grammar_element)(unsafe.Pointer(&row[0]))
+	}
+	handle := C.llama_grammar_init(
+		(**C.struct_llama_grammar_element)(rows),
+		C.size_t(n),
+		C.size_t(g.root),
+	)
+	if handle == nil {
+		return nil, fmt.Errorf(`llama_grammar_init failed`)
+	}
+	return &compiledGrammar{handle: handle}, nil
+}
+
+func (g *compiledGrammar) free() {
+	if g == nil || g.handle == nil {
+		return
+	}
+	C.llama_grammar_free(g.handle)
+	g.handle = nil
+}
+
+// acceptToken advances the grammar's internal stack past token, so the next call to llm_go_sample constrains
+// candidates to whatever may legally follow it.
+func (g *compiledGrammar) acceptToken(ctx *C.struct_llama_context, token Token) {
+	if g == nil || g.handle == nil {
+		return
+	}
+	C.llama_grammar_accept_token(ctx, g.handle, C.llama_token(token))
+}
@@ -43,11 +43,38 @@ int llm_go_eval(struct llama_context *ctx, int pos, llama_token *tokens, int n_t
 	return e;
 }
 
+// llm_go_eval_all behaves like llm_go_eval, but requests logits for every token in the batch instead of just the
+// last one, so a caller can later sample at any of those positions -- used to verify a run of drafted tokens
+// against the main model in a single decode.
+int llm_go_eval_all(struct llama_context *ctx, int pos, llama_token *tokens, int n_tokens) {
+	if (n_tokens < 1) return 0;
+	llama_batch batch = llama_batch_init(n_tokens, 0, 1);
+	batch.n_tokens = n_tokens;
+	for (int i = 0; i < n_tokens; i++) {
+		batch.token[i] = tokens[i];
+		batch.pos[i] = pos + i;
+		batch.seq_id[i][0] = 0;
+		batch.n_seq_id[i] = 1;
+		batch.logits[i] = true;
+	}
+	int e = llama_decode(ctx, batch);
+	llama_batch_free(batch);
+	return e;
+}
+
+// llm_go_logits returns the raw, pre-sampling logits for pos, so Go can apply a logit bias, ignore_eos, or a
+// LogitsProcessor chain before the candidate-selection phase in llm_go_sample runs over the same buffer.
+float *llm_go_logits(struct llama_context *ctx, int pos, int *n_vocab) {
+	*n_vocab = llama_n_vocab(llama_get_model(ctx));
+	return llama_get_logits_ith(ctx, pos);
+}
+
 llama_token llm_go_sample(
 	struct llama_context *ctx,
 	struct llm_go_params *params,
 	int pos,
-	llama_token *last_tokens, int n_last_tokens
+	llama_token *last_tokens, int n_last_tokens,
+	struct llama_grammar *grammar
 ) {
 	float *logits = llama_get_logits_ith(ctx, pos);
 	if (logits == NULL) {
@@ -83,6 +110,10 @@ llama_token llm_go_sample(
 		}
 	}
 
+	if (grammar != NULL) {
+		llama_sample_grammar(ctx, &candidates, grammar);
+	}
+
 	llama_token token = 0;
 
 	if (params->temperature <= 0) {
@@ -133,6 +164,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"math/rand"
 	"runtime"
 	"strings"
@@ -143,8 +175,11 @@ import (
 	"github.com/swdunlop/llm-go/internal/kmp"
 )
 
-func Load(modelPath string) (Model, error) {
+func Load(modelPath string, opts ...Option) (Model, error) {
 	m := &model{}
+	for _, opt := range opts {
+		opt(m)
+	}
 	err := m.load(modelPath)
 	if err != nil {
 		return nil, err
@@ -152,22 +187,35 @@ func Load(modelPath string) (Model, error) {
 	return m, nil
 }
 
+// Option configures a Model at Load time.
+type Option func(*model)
+
 type Model interface {
 	Close()
 	Encode(string) []Token
 	Decode([]Token) string
 	Predict(*zerolog.Logger, *Parameters, []Token) (Stream, error)
+
+	// LoadSession restores a Stream from a session file written by Stream.SaveSession, skipping re-evaluation of
+	// its prompt entirely.
+	LoadSession(path string, pp *Parameters) (Stream, error)
 }
 
 type Stream interface {
 	Close()
 	Next([]Token) (Token, error)
+
+	// SaveSession persists the stream's current KV state and token history to path, for later use with
+	// Model.LoadSession.
+	SaveSession(path string) error
 }
 
 type model struct {
 	llama        *C.struct_llama_model
+	path         string // as passed to Load; see Model.LoadSession
 	bos, eos, nl Token
-	nCtx         int // trained context size
+	nCtx         int   // trained context size
+	cache        Cache // optional, see WithCache
 	last         struct {
 		control sync.Mutex
 		stream  *stream
@@ -183,6 +231,7 @@ func (m *model) load(modelPath string) error {
 	if m.llama == nil {
 		return fmt.Errorf("failed to load %q", modelPath)
 	}
+	m.path = modelPath
 	m.nCtx = int(C.llama_n_ctx_train(m.llama))
 	if m.nCtx < 1 {
 		C.llama_free_model(m.llama)
@@ -270,12 +319,23 @@ type stream struct {
 	params struct {
 		sample C.struct_llm_go_params
 	}
+	nKeep, nDiscard int               // see Parameters.NKeep, Parameters.NDiscard
+	grammar         *compiledGrammar  // see Parameters.Grammar
+	ignoreEOS       bool              // see Parameters.IgnoreEOS
+	logitBias       map[Token]float32 // see Parameters.LogitBias
+	processors      []LogitsProcessor // see Parameters.Processors
 
 	history []Token
 }
 
 func (s *stream) init(tokens []Token, pp *Parameters) error {
 	applyParameters(&s.params.sample, pp)
+	s.nKeep, s.nDiscard = pp.NKeep, pp.NDiscard
+	s.ignoreEOS, s.logitBias, s.processors = pp.IgnoreEOS, pp.LogitBias, pp.Processors
+	err := s.applyGrammar(pp)
+	if err != nil {
+		return err
+	}
 
 	cp := params.context
 	cp.n_ctx = C.uint(s.model.nCtx)
@@ -300,22 +360,55 @@ func (s *stream) init(tokens []Token, pp *Parameters) error {
 	}
 	C.llama_set_rng_seed(s.llama, C.uint32_t(pp.Seed))
 
-	err := s.eval(tokens...)
+	rest := tokens
+	if s.model.cache != nil {
+		if state, matched, ok := s.model.cache.Get(tokens); ok && matched > 0 {
+			state.restore(s.llama)
+			// The snapshot may cover a longer prefix than matched (tokens diverges from it partway through, or
+			// tokens is simply shorter); drop whatever it holds past matched so cells from the other prefix's
+			// continuation are not left in the context for later tokens to attend to.
+			rmCache(s.llama, 0, matched, -1)
+			s.history = append(s.history, tokens[:matched]...)
+			rest = tokens[matched:]
+			s.log.Trace().Int(`matched`, matched).Msg(`restored state from cache`)
+		}
+	}
+
+	err = s.eval(rest...)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-// reset identifies the overlap between the history of the stream and the tokens then resets the batch.
+// reset identifies the overlap between the history of the stream and the tokens then resets the batch. If the
+// model has a Cache and it holds a longer matching prefix than the stream's own retained history, that snapshot
+// is restored instead, the same way init favors it over evaluating from scratch.
 func (s *stream) reset(tokens []Token, pp *Parameters) error {
 	applyParameters(&s.params.sample, pp)
+	s.nKeep, s.nDiscard = pp.NKeep, pp.NDiscard
+	s.ignoreEOS, s.logitBias, s.processors = pp.IgnoreEOS, pp.LogitBias, pp.Processors
+	err := s.applyGrammar(pp)
+	if err != nil {
+		return err
+	}
 
 	n, m := len(tokens), cap(s.history)
 	if n > m {
 		return fmt.Errorf(`%v tokens of input exceeds maximum %v tokens`, len(tokens), cap(s.history))
 	}
 	sz, pos := kmp.Overlap(tokens, s.history)
+
+	if s.model.cache != nil {
+		if state, matched, ok := s.model.cache.Get(tokens); ok && matched > sz {
+			state.restore(s.llama)
+			rmCache(s.llama, 0, matched, -1)
+			s.history = append(s.history[:0], tokens[:matched]...)
+			s.log.Trace().Int(`matched`, matched).Msg(`restored state from cache`)
+			return s.eval(tokens[matched:]...)
+		}
+	}
+
 	end := pos + sz
 	s.log.Trace().Int(`history`, len(s.history)).Int(`pos`, pos).Int(`sz`, sz).Msg(`resetting stream`)
 
@@ -324,11 +417,7 @@ func (s *stream) reset(tokens []Token, pp *Parameters) error {
 
 	copy(s.history, s.history[pos:])
 	s.history = s.history[:sz]
-	err := s.eval(tokens[sz:]...)
-	if err != nil {
-		return err
-	}
-	return nil
+	return s.eval(tokens[sz:]...)
 }
 
 // shiftCache moves the range of batch tokens from start to stop by delta.  seqID is generally 0 since we do not use
@@ -350,6 +439,10 @@ func (s *stream) Close() {
 	if s.llama == nil {
 		return
 	}
+	if s.model.cache != nil {
+		prefix := append([]Token(nil), s.history...)
+		s.model.cache.Put(prefix, captureState(s.llama))
+	}
 	s.model.last.control.Lock()
 	if s.model.last.stream != nil {
 		s.model.last.stream.free()
@@ -361,12 +454,70 @@ func (s *stream) Close() {
 func (s *stream) free() {
 	C.llama_free(s.llama)
 	s.llama = nil
+	s.grammar.free()
+	s.grammar = nil
+}
+
+// applyGrammar compiles pp.Grammar, if any, replacing whatever grammar the stream held for a previous Predict
+// call.
+func (s *stream) applyGrammar(pp *Parameters) error {
+	s.grammar.free()
+	s.grammar = nil
+	if pp.Grammar == `` {
+		return nil
+	}
+	g, err := ParseGrammar(pp.Grammar)
+	if err != nil {
+		return fmt.Errorf(`parsing grammar: %w`, err)
+	}
+	s.grammar, err = g.compile()
+	if err != nil {
+		return fmt.Errorf(`compiling grammar: %w`, err)
+	}
+	return nil
+}
+
+// evict makes room for at least need more tokens by dropping NDiscard tokens from the context immediately after
+// the NKeep attention-sink prefix, repeating until there is enough headspace. This mirrors the StreamingLLM
+// technique of preserving the initial "sink" tokens so attention distributions remain stable during unbounded
+// generation, turning what would otherwise be a hard ContextFull into a sliding window.
+func (s *stream) evict(need int) error {
+	for cap(s.history)-len(s.history)-5 < need {
+		keep := s.nKeep
+		if keep < 1 {
+			keep = 1 // BOS (see stream.init) is always retained as part of the attention sink, even if NKeep is 0.
+		}
+		if keep > len(s.history) {
+			keep = len(s.history)
+		}
+		discard := s.nDiscard
+		if keep+discard > len(s.history) {
+			discard = len(s.history) - keep
+		}
+		if discard <= 0 {
+			return ContextFull{}
+		}
+		end := keep + discard
+		rmCache(s.llama, 0, keep, end)
+		shiftCache(s.llama, 0, end, len(s.history), -discard)
+		s.history = append(s.history[:keep], s.history[end:]...)
+		s.log.Trace().
+			Int(`nKeep`, keep).Int(`nDiscard`, discard).Int(`history`, len(s.history)).
+			Msg(`evicted context`)
+	}
+	return nil
 }
 
 func (s *stream) Next(tokens []Token) (Token, error) {
 	headspace := cap(s.history) - len(s.history) - 5
 	if headspace < len(tokens) {
-		return 0, ContextFull{}
+		if s.nDiscard <= 0 {
+			return 0, ContextFull{}
+		}
+		err := s.evict(len(tokens))
+		if err != nil {
+			return 0, err
+		}
 	}
 	// TODO: check for nBatch < nCtx
 	err := s.eval(tokens...)
@@ -387,14 +538,67 @@ func (s *stream) Next(tokens []Token) (Token, error) {
 	return token, nil
 }
 
+// applyLogits runs the logits-manipulation phase for pos: ignore_eos, the logit bias map, and any LogitsProcessor
+// chain, all mutating the context's own logits buffer in place ahead of the candidate-selection phase in
+// llm_go_sample.
+func (s *stream) applyLogits(pos int) {
+	if !s.ignoreEOS && len(s.logitBias) == 0 && len(s.processors) == 0 {
+		return
+	}
+	var nVocab C.int
+	ptr := C.llm_go_logits(s.llama, C.int(pos), &nVocab)
+	if ptr == nil {
+		return
+	}
+	logits := unsafe.Slice((*float32)(unsafe.Pointer(ptr)), int(nVocab))
+	if s.ignoreEOS {
+		logits[s.model.eos] = float32(math.Inf(-1))
+	}
+	for token, bias := range s.logitBias {
+		if int(token) >= 0 && int(token) < len(logits) {
+			logits[token] += bias
+		}
+	}
+	for _, p := range s.processors {
+		p(pos, s.history, logits)
+	}
+}
+
 func (s *stream) sample() (Token, error) {
-	pos := len(s.history) - 1
+	token, err := s.sampleAt(len(s.history) - 1)
+	if err != nil {
+		return 0, err
+	}
+	s.grammar.acceptToken(s.llama, token)
+	return token, nil
+}
+
+// sampleAt samples from the logits already computed for pos, an index into history, without advancing grammar
+// state, using the entire history as the repetition-penalty window. Speculative decoding uses sampleAtWindow
+// instead, to verify several drafted tokens against logits produced by a single evalAll, where only the token
+// actually accepted should advance the grammar.
+func (s *stream) sampleAt(pos int) (Token, error) {
+	return s.sampleAtWindow(pos, len(s.history))
+}
+
+// sampleAtWindow behaves like sampleAt, but computes repetition/frequency/presence penalties only over
+// history[:n] rather than the full history. This matters when history already holds tokens beyond pos -- as
+// evalAll leaves it after a speculative verification batch -- since a real step-by-step generation at pos would
+// not yet have seen those later tokens, and including them would shift which token is sampled.
+func (s *stream) sampleAtWindow(pos, n int) (Token, error) {
+	s.applyLogits(pos)
+	var grammar *C.struct_llama_grammar
+	if s.grammar != nil {
+		grammar = s.grammar.handle
+	}
+	window := s.history[:n]
 	token := C.llm_go_sample(
 		s.llama,
 		&s.params.sample,
 		C.int(pos),
-		unsafe.SliceData(s.history),
-		C.int(len(s.history)),
+		unsafe.SliceData(window),
+		C.int(len(window)),
+		grammar,
 	)
 	s.log.Trace().
 		Int(`pos`, pos).
@@ -426,8 +630,31 @@ func (s *stream) eval(tokens ...Token) error {
 	return fmt.Errorf(`eval failed with error %v`, e)
 }
 
+// evalAll behaves like eval, but requests logits for every position in tokens rather than just the last one, so a
+// verifier can sampleAt any of them afterwards. Speculative decoding uses this to check several drafted tokens
+// against one batched decode of the main model.
+func (s *stream) evalAll(tokens ...Token) error {
+	if len(tokens) == 0 {
+		return nil
+	}
+	e := C.llm_go_eval_all(s.llama, C.int(len(s.history)), unsafe.SliceData(tokens), C.int(len(tokens)))
+	if e == 0 {
+		s.history = append(s.history, tokens...)
+		return nil
+	}
+	if e == 1 {
+		return fmt.Errorf(`eval failed, cache overflow`)
+	}
+	return fmt.Errorf(`eval failed with error %v`, e)
+}
+
 type Token = C.int32_t
 
+// LogitsProcessor adjusts logits in place for the token about to be sampled at pos, given the tokens evaluated so
+// far. It runs after LogitBias and before the rest of the sampling pipeline, letting callers implement things like
+// classifier-free guidance, custom repetition schemes, or DRY sampling entirely in Go.
+type LogitsProcessor func(pos int, history []Token, logits []float32)
+
 type ContextFull struct{}
 
 func (ContextFull) Error() string { return `context full` }
@@ -485,8 +712,15 @@ type Parameters struct {
 	// NPredict specifies the number of tokens to predict when generating text. Note: May exceed the set limit slightly if the last token is a partial multibyte character. When 0, no tokens will be generated but the prompt is evaluated into the cache. (default: 128, -1 = infinity).
 	NPredict int `json:"n_predict"`
 
-	// NKeep specifies the number of tokens from the initial prompt to retain when the model resets its internal context. By default, this value is set to 0 (meaning no tokens are kept). Use -1 to retain all tokens from the initial prompt.
-	// TODO NKeep int `json:"n_keep"`
+	// NKeep specifies the number of tokens at the start of the context, counting BOS, to retain as an attention sink
+	// when Next would otherwise run out of context. BOS is always kept, so 0 and 1 both keep BOS alone; by default,
+	// this value is 0, meaning no prompt tokens beyond BOS itself are kept.
+	NKeep int `json:"n_keep"`
+
+	// NDiscard specifies how many tokens to evict from the context immediately after the NKeep attention sink when
+	// Next runs out of room, rather than failing with ContextFull. 0 disables eviction and preserves the previous
+	// behavior of returning ContextFull once the context fills up.
+	NDiscard int `json:"n_discard"`
 
 	// TFSZ enables tail free sampling with parameter z (default: 1.0, 1.0 = disabled).
 	TFSZ float32 `json:"tfsz"`
@@ -515,9 +749,20 @@ type Parameters struct {
 	// mirostat_eta: Set the Mirostat learning rate, parameter eta (default: 0.1).
 	MirostatEta float32 `json:"mirostat_eta,omitempty"`
 
-	// TODO: grammar
-	// TODO: ignore_eos
-	// TODO: logit_bias
+	// Grammar constrains sampling to a GBNF grammar (see ParseGrammar), e.g. to force valid JSON or a custom DSL.
+	// Empty disables grammar-constrained sampling (default).
+	Grammar string `json:"grammar,omitempty"`
+
+	// IgnoreEOS prevents the end-of-sequence token from ever being sampled, by biasing its logit to -Inf, so
+	// generation only stops once NPredict tokens have been produced.
+	IgnoreEOS bool `json:"ignore_eos"`
+
+	// LogitBias adds a per-token bias to the logits before sampling, e.g. to discourage or force specific tokens.
+	LogitBias map[Token]float32 `json:"logit_bias,omitempty"`
+
+	// Processors is a chain of Go-side LogitsProcessor functions applied, in order, after LogitBias and before the
+	// rest of the sampling pipeline. It is not serialized; set it directly on a Parameters passed to Predict.
+	Processors []LogitsProcessor `json:"-"`
 
 	// Seed to use for prediction and sampling.  If 0, a random seed will be used.
 	Seed uint32 `json:"seed,omitempty"`
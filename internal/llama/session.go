@@ -0,0 +1,126 @@
+package llama
+
+/*
+#include <stdlib.h>
+#include "llama.h"
+*/
+import "C"
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"unsafe"
+
+	"github.com/rs/zerolog"
+)
+
+// ggsn ("ggml sessioN") is the format of the small header SaveSession writes alongside the llama.cpp-owned KV
+// blob: a magic, a version, and a checksum of the model path that produced it. llama_save_session_file/
+// llama_load_session_file validate their own magic, version and checksum, and reject a file whose n_ctx does not
+// fit the context it's loaded into, but not which model's weights the KV state was actually computed from --
+// restoring a session from a different model of the same architecture and n_ctx would otherwise succeed and feed
+// semantically wrong KV into generation. The header binds a session to the model it was saved from so that case
+// is rejected cleanly instead.
+const (
+	ggsnMagic   = `ggsn`
+	ggsnVersion = uint32(1)
+)
+
+// sessionKVPath is where the llama.cpp-owned session blob lives; path itself holds only the ggsn header.
+func sessionKVPath(path string) string { return path + `.kv` }
+
+// fingerprint identifies the model backing m for SaveSession/LoadSession, so a session can be bound to the model
+// that produced it.
+func (m *model) fingerprint() uint32 {
+	return crc32.ChecksumIEEE([]byte(m.path))
+}
+
+// SaveSession persists the stream's current KV state and token history to path, using llama_save_session_file for
+// the KV blob and a small ggsn header binding it to the model.
+func (s *stream) SaveSession(path string) error {
+	err := writeSessionHeader(path, s.model.fingerprint())
+	if err != nil {
+		return err
+	}
+
+	cPath := C.CString(sessionKVPath(path))
+	defer C.free(unsafe.Pointer(cPath))
+	ok := C.llama_save_session_file(s.llama, cPath, unsafe.SliceData(s.history), C.size_t(len(s.history)))
+	if !bool(ok) {
+		return fmt.Errorf(`failed to save session to %q`, path)
+	}
+	return nil
+}
+
+// LoadSession restores a Stream from a session file written by SaveSession, using llama_load_session_file, without
+// re-evaluating its prompt.
+func (m *model) LoadSession(path string, pp *Parameters) (Stream, error) {
+	err := checkSessionHeader(path, m.fingerprint())
+	if err != nil {
+		return nil, err
+	}
+
+	log := zerolog.Nop()
+	s := &stream{model: m, log: &log}
+	applyParameters(&s.params.sample, pp)
+	s.nKeep, s.nDiscard = pp.NKeep, pp.NDiscard
+	s.ignoreEOS, s.logitBias, s.processors = pp.IgnoreEOS, pp.LogitBias, pp.Processors
+	err = s.applyGrammar(pp)
+	if err != nil {
+		return nil, err
+	}
+
+	cp := params.context
+	cp.n_ctx = C.uint(m.nCtx)
+	cp.n_batch = cp.n_ctx
+
+	s.llama = C.llama_new_context_with_model(m.llama, cp)
+	if s.llama == nil {
+		return nil, fmt.Errorf(`failed to create context from model`)
+	}
+	C.llama_set_rng_seed(s.llama, C.uint32_t(pp.Seed))
+
+	cPath := C.CString(sessionKVPath(path))
+	defer C.free(unsafe.Pointer(cPath))
+	max := int(cp.n_ctx) - 5
+	tokens := make([]Token, max)
+	var n C.size_t
+	ok := C.llama_load_session_file(s.llama, cPath, unsafe.SliceData(tokens), C.size_t(len(tokens)), &n)
+	if !bool(ok) {
+		C.llama_free(s.llama)
+		return nil, fmt.Errorf(`failed to load session from %q`, path)
+	}
+
+	s.history = make([]Token, 0, cp.n_ctx)
+	s.history = append(s.history, tokens[:n]...)
+	return s, nil
+}
+
+func writeSessionHeader(path string, fingerprint uint32) error {
+	var hdr [12]byte
+	copy(hdr[:4], ggsnMagic)
+	binary.LittleEndian.PutUint32(hdr[4:8], ggsnVersion)
+	binary.LittleEndian.PutUint32(hdr[8:12], fingerprint)
+	return os.WriteFile(path, hdr[:], 0o644)
+}
+
+func checkSessionHeader(path string, fingerprint uint32) error {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if len(buf) != 12 || string(buf[:4]) != ggsnMagic {
+		return fmt.Errorf(`%q is not a ggsn session file`, path)
+	}
+	version := binary.LittleEndian.Uint32(buf[4:8])
+	if version != ggsnVersion {
+		return fmt.Errorf(`%q is ggsn version %v, this build only understands version %v`, path, version, ggsnVersion)
+	}
+	got := binary.LittleEndian.Uint32(buf[8:12])
+	if got != fingerprint {
+		return fmt.Errorf(`%q was saved from a different model`, path)
+	}
+	return nil
+}
@@ -0,0 +1,268 @@
+package llama
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/rs/zerolog"
+)
+
+// LoadSpeculative loads a pair of models for speculative decoding: mainPath is the model whose output quality and
+// distribution callers actually want, draftPath is a smaller, faster model (sharing mainPath's vocabulary) used to
+// propose up to nDraft candidate tokens per step. Predict verifies each candidate against the main model's own
+// distribution in a single batched decode, so generation only pays the main model's full cost once per accepted
+// run of tokens rather than once per token. nDraft defaults to 4 if less than 1.
+func LoadSpeculative(mainPath, draftPath string, nDraft int) (Model, error) {
+	if nDraft < 1 {
+		nDraft = 4
+	}
+	mainModel, err := Load(mainPath)
+	if err != nil {
+		return nil, fmt.Errorf(`loading main model: %w`, err)
+	}
+	draftModel, err := Load(draftPath)
+	if err != nil {
+		mainModel.Close()
+		return nil, fmt.Errorf(`loading draft model: %w`, err)
+	}
+	return &specModel{main: mainModel.(*model), draft: draftModel.(*model), nDraft: nDraft}, nil
+}
+
+type specModel struct {
+	main, draft *model
+	nDraft      int
+}
+
+// checkSpeculativeParameters rejects Parameters this package's verification scheme cannot honor, rather than
+// silently producing output that does not match what a plain Predict against the main model would have: fill
+// only ever accepts a candidate on an exact match against the main model's own greedy/sampled token, which is not
+// target-distribution-preserving for temperature>0 (real speculative decoding needs a min(1, p_main/p_draft)
+// accept with a renormalized-residual resample, not implemented here); and grammar state can only safely advance
+// for tokens that were actually accepted, which fill's speculative rejection does not track.
+func checkSpeculativeParameters(pp *Parameters) error {
+	if pp.Temperature > 0 {
+		return fmt.Errorf(`speculative decoding only supports greedy sampling (temperature 0); got %v`, pp.Temperature)
+	}
+	if pp.Grammar != `` {
+		return fmt.Errorf(`speculative decoding does not support Parameters.Grammar`)
+	}
+	return nil
+}
+
+func (m *specModel) Close() {
+	m.main.Close()
+	m.draft.Close()
+}
+
+// Encode and Decode defer entirely to the main model; the draft model is expected to share its vocabulary.
+func (m *specModel) Encode(text string) []Token   { return m.main.Encode(text) }
+func (m *specModel) Decode(tokens []Token) string { return m.main.Decode(tokens) }
+
+func (m *specModel) Predict(log *zerolog.Logger, pp *Parameters, tokens []Token) (Stream, error) {
+	if err := checkSpeculativeParameters(pp); err != nil {
+		return nil, err
+	}
+	mainStream, err := m.main.Predict(log, pp, tokens)
+	if err != nil {
+		return nil, err
+	}
+	draftStream, err := m.draft.Predict(log, pp, tokens)
+	if err != nil {
+		mainStream.Close()
+		return nil, err
+	}
+	return &specStream{
+		main:   mainStream.(*stream),
+		draft:  draftStream.(*stream),
+		nDraft: m.nDraft,
+		log:    log,
+	}, nil
+}
+
+// LoadSession restores the main model's stream from path and re-primes the draft model over the same restored
+// history, rather than also persisting and restoring draft state, which SaveSession does not capture.
+func (m *specModel) LoadSession(path string, pp *Parameters) (Stream, error) {
+	if err := checkSpeculativeParameters(pp); err != nil {
+		return nil, err
+	}
+	mainStream, err := m.main.LoadSession(path, pp)
+	if err != nil {
+		return nil, err
+	}
+	ms := mainStream.(*stream)
+
+	log := zerolog.Nop()
+	draftStream, err := m.draft.Predict(&log, pp, ms.history[1:]) // Predict re-prepends the draft model's own BOS.
+	if err != nil {
+		mainStream.Close()
+		return nil, err
+	}
+	return &specStream{main: ms, draft: draftStream.(*stream), nDraft: m.nDraft, log: &log}, nil
+}
+
+// specStream dispenses one Token per Next call from a run accepted by fill, drafting and verifying another run
+// once that buffer is empty. See checkSpeculativeParameters for the Parameters this package rejects up front
+// rather than silently handling incorrectly.
+type specStream struct {
+	main, draft *stream
+	nDraft      int
+	log         *zerolog.Logger
+	pending     []Token
+}
+
+func (s *specStream) Close() {
+	s.main.Close()
+	s.draft.Close()
+}
+
+// SaveSession persists only the main model's state; see LoadSession for why the draft model is re-primed rather
+// than restored.
+func (s *specStream) SaveSession(path string) error {
+	return s.main.SaveSession(path)
+}
+
+func (s *specStream) Next(tokens []Token) (Token, error) {
+	if len(s.pending) == 0 {
+		err := s.fill(tokens)
+		if err != nil {
+			return 0, err
+		}
+	}
+	token := s.pending[0]
+	s.pending = s.pending[1:]
+	if token == s.main.model.eos {
+		return 0, io.EOF
+	}
+	return token, nil
+}
+
+// fill evaluates tokens on both streams, drafts up to nDraft candidate tokens from the draft model, and verifies
+// them against the main model in a single evalAll. Candidates are accepted greedily while the main model's own
+// greedily-sampled token matches the draft's proposal exactly -- checkSpeculativeParameters rejects
+// Parameters.Temperature>0 up front, since this is not the target-distribution-preserving rejection sampling real
+// speculative decoding needs there; the run stops at the first mismatch, using the main model's token in place of
+// the wrong guess. If every candidate is accepted, one further "bonus"
+// token is sampled for free from the position the verification left the main model's cache in. A draft candidate
+// can never itself be end-of-sequence (the draft loop stops drafting before proposing one), so end-of-sequence can
+// only surface as a divergent actual or as the bonus token; either way it is left out of both caches so the stream
+// mirrors stream.Next and Next can report io.EOF for it instead of dispensing it as an ordinary token.
+func (s *specStream) fill(tokens []Token) error {
+	err := s.main.eval(tokens...)
+	if err != nil {
+		return err
+	}
+	err = s.draft.eval(tokens...)
+	if err != nil {
+		return err
+	}
+
+	var draftTokens []Token
+	for i := 0; i < s.nDraft; i++ {
+		token, err := s.draft.sample()
+		if err != nil || token == s.draft.model.eos {
+			break
+		}
+		err = s.draft.eval(token)
+		if err != nil {
+			return err
+		}
+		draftTokens = append(draftTokens, token)
+	}
+	if len(draftTokens) == 0 {
+		return s.fillOne()
+	}
+
+	before := len(s.main.history)
+	err = s.main.evalAll(draftTokens...)
+	if err != nil {
+		return err
+	}
+
+	accepted := make([]Token, 0, len(draftTokens)+1)
+	for i, proposed := range draftTokens {
+		// The repetition-penalty window must stop at this position's own history, not grow with each draft
+		// token evalAll has already appended -- otherwise verifying draftTokens[i] would be penalized against
+		// draftTokens[i+1:], which a real step-by-step generation would not yet have seen.
+		actual, err := s.main.sampleAtWindow(before-1+i, before+i)
+		if err != nil {
+			return err
+		}
+		if actual != proposed {
+			return s.diverge(before+i, actual, accepted)
+		}
+		accepted = append(accepted, proposed)
+	}
+
+	bonus, err := s.main.sample()
+	if err != nil {
+		return err
+	}
+	if bonus == s.main.model.eos {
+		s.log.Trace().Int(`drafted`, len(draftTokens)).Msg(`speculative decode: bonus token is end of sequence`)
+		s.pending = append(accepted, bonus)
+		return nil
+	}
+	err = s.main.eval(bonus)
+	if err != nil {
+		return err
+	}
+	err = s.draft.eval(bonus)
+	if err != nil {
+		return err
+	}
+	s.log.Trace().Int(`drafted`, len(draftTokens)).Msg(`speculative decode: every candidate accepted`)
+	s.pending = append(accepted, bonus)
+	return nil
+}
+
+// fillOne falls back to an ordinary single-token step on the main model, used when the draft model had nothing to
+// propose (e.g. it produced its own end-of-sequence immediately).
+func (s *specStream) fillOne() error {
+	token, err := s.main.sample()
+	if err != nil {
+		return err
+	}
+	if token == s.main.model.eos {
+		s.pending = []Token{token}
+		return nil
+	}
+	err = s.main.eval(token)
+	if err != nil {
+		return err
+	}
+	err = s.draft.eval(token)
+	if err != nil {
+		return err
+	}
+	s.pending = []Token{token}
+	return nil
+}
+
+// diverge trims both streams' KV caches and history back to at, appends the main model's own token there instead
+// of the draft's wrong guess, and leaves accepted (the prefix of draftTokens that did match) plus that token as
+// the run to dispense.
+func (s *specStream) diverge(at int, actual Token, accepted []Token) error {
+	rmCache(s.main.llama, 0, at, -1)
+	s.main.history = s.main.history[:at]
+	rmCache(s.draft.llama, 0, at, -1)
+	s.draft.history = s.draft.history[:at]
+
+	if actual == s.main.model.eos {
+		s.log.Trace().Int(`matched`, len(accepted)).Msg(`speculative decode: diverged to end of sequence`)
+		s.pending = append(accepted, actual)
+		return nil
+	}
+
+	err := s.main.eval(actual)
+	if err != nil {
+		return err
+	}
+	err = s.draft.eval(actual)
+	if err != nil {
+		return err
+	}
+
+	s.log.Trace().Int(`matched`, len(accepted)).Msg(`speculative decode: diverged from draft`)
+	s.pending = append(accepted, actual)
+	return nil
+}